@@ -0,0 +1,225 @@
+package main
+
+import (
+	"bytes"
+	"compress/bzip2"
+	"crypto/sha256"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+
+	"github.com/andybalholm/brotli"
+	"github.com/gabstv/go-bsdiff/pkg/bspatch"
+	"github.com/xi2/xz"
+)
+
+// extentsTotalBytes sums the byte span covered by a list of extents.
+func extentsTotalBytes(extents []*Extent, blockSize uint32) int64 {
+	var total int64
+	for _, e := range extents {
+		total += int64(e.GetNumBlocks()) * int64(blockSize)
+	}
+	return total
+}
+
+// writeExtents consumes exactly extentsTotalBytes(extents, blockSize) bytes
+// from data and scatters them into output at the byte offsets described by
+// extents, in order. Using WriteAt rather than a sequential writer means
+// operations can be applied in any order, which delta payloads require.
+func writeExtents(output io.WriterAt, data io.Reader, extents []*Extent, blockSize uint32) error {
+	for _, e := range extents {
+		n := int64(e.GetNumBlocks()) * int64(blockSize)
+		offset := int64(e.GetStartBlock()) * int64(blockSize)
+		buf := make([]byte, n)
+		if _, err := io.ReadFull(data, buf); err != nil {
+			return fmt.Errorf("Failed to read %d bytes for extent at block %d: %v", n, e.GetStartBlock(), err)
+		}
+		if _, err := output.WriteAt(buf, offset); err != nil {
+			return fmt.Errorf("Failed to write extent at offset %d: %v", offset, err)
+		}
+	}
+	return nil
+}
+
+// readExtents returns a reader over the concatenation of the byte ranges
+// described by extents within src.
+func readExtents(src io.ReaderAt, extents []*Extent, blockSize uint32) io.Reader {
+	readers := make([]io.Reader, len(extents))
+	for i, e := range extents {
+		offset := int64(e.GetStartBlock()) * int64(blockSize)
+		n := int64(e.GetNumBlocks()) * int64(blockSize)
+		readers[i] = io.NewSectionReader(src, offset, n)
+	}
+	return io.MultiReader(readers...)
+}
+
+// zeroReader is an endless stream of zero bytes, used for ZERO/DISCARD operations.
+type zeroReader struct{}
+
+func (zeroReader) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = 0
+	}
+	return len(p), nil
+}
+
+// readOperationData reads and, if a data hash is present, verifies the raw
+// payload bytes for an operation. This is shared by every operation type
+// that carries its own data blob in the payload (everything but SOURCE_COPY,
+// ZERO, and DISCARD). It reads via a section reader over pd.src rather than
+// seeking a shared handle, so concurrent workers never race on position.
+func (pd *payloadDumper) readOperationData(iop *InstallOperation, readBuf *bytes.Buffer) ([]byte, error) {
+	readStart := int64(iop.GetDataOffset())
+	readSize := int64(iop.GetDataLength())
+	readBuf.Reset()
+
+	section := io.NewSectionReader(pd.src, pd.dataOffset+readStart, readSize)
+
+	var srcDataReader io.Reader = section
+	var hasher hash.Hash
+	if len(iop.GetDataSha256Hash()) > 0 {
+		hasher = sha256.New()
+		srcDataReader = io.TeeReader(section, hasher)
+	}
+
+	bytesRead, err := io.CopyN(readBuf, srcDataReader, readSize)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read install operation: %v", err)
+	}
+	if bytesRead != readSize {
+		return nil, fmt.Errorf("Read %d bytes, expecting %d", bytesRead, readSize)
+	}
+
+	if hasher != nil {
+		dataSum := hasher.Sum(nil)
+		if !bytes.Equal(dataSum, iop.GetDataSha256Hash()) {
+			return nil, fmt.Errorf("SHA256 failed for operation data, expected %x, calculated %x", iop.GetDataSha256Hash(), dataSum)
+		}
+	}
+
+	return readBuf.Bytes(), nil
+}
+
+// readSourceExtents reads and, if a source hash is present, verifies the
+// source bytes an operation reads from the previous partition image.
+func readSourceExtents(sourceImage io.ReaderAt, iop *InstallOperation, blockSize uint32) ([]byte, error) {
+	srcBytes, err := ioutil.ReadAll(readExtents(sourceImage, iop.GetSrcExtents(), blockSize))
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read source extents: %v", err)
+	}
+	if expected := iop.GetSrcSha256Hash(); len(expected) > 0 {
+		sum := sha256.Sum256(srcBytes)
+		if !bytes.Equal(sum[:], expected) {
+			return nil, fmt.Errorf("SHA256 failed for source extents, expected %x, calculated %x", expected, sum)
+		}
+	}
+	return srcBytes, nil
+}
+
+// applyPuffpatch would reconstruct destination bytes from source bytes and a
+// puffin patch. Puffin re-encodes embedded deflate streams into a
+// diff-friendly "puffed" representation, bit-realigns Huffman tables, and
+// bsdiff-s the result; reproducing that reliably requires a real puffin
+// decoder, which this package doesn't have. Rather than guess at the wire
+// format and silently produce corrupt partitions, PUFFDIFF is reported as
+// unsupported below.
+func applyPuffpatch(src, patch []byte) ([]byte, error) {
+	return nil, fmt.Errorf("PUFFDIFF operations are not supported: puffin patch reconstruction is not implemented")
+}
+
+func (pd *payloadDumper) performInstallOperation(sourceImage io.ReaderAt, output io.WriterAt, iop *InstallOperation, readBuf *bytes.Buffer, blockSize uint32) (err error) {
+	switch iop.GetType() {
+	case InstallOperation_REPLACE, InstallOperation_REPLACE_XZ, InstallOperation_REPLACE_BZ:
+		return pd.performReplaceOperation(output, iop, readBuf, blockSize)
+	case InstallOperation_SOURCE_COPY:
+		return performSourceCopyOperation(sourceImage, output, iop, blockSize)
+	case InstallOperation_SOURCE_BSDIFF, InstallOperation_BROTLI_BSDIFF:
+		return pd.performSourceBsdiffOperation(sourceImage, output, iop, readBuf, blockSize)
+	case InstallOperation_PUFFDIFF:
+		return pd.performPuffdiffOperation(sourceImage, output, iop, readBuf, blockSize)
+	case InstallOperation_ZERO, InstallOperation_DISCARD:
+		total := extentsTotalBytes(iop.GetDstExtents(), blockSize)
+		return writeExtents(output, io.LimitReader(zeroReader{}, total), iop.GetDstExtents(), blockSize)
+	default:
+		return fmt.Errorf("Unimplemented install operation type: %v", iop.GetType())
+	}
+}
+
+func (pd *payloadDumper) performReplaceOperation(output io.WriterAt, iop *InstallOperation, readBuf *bytes.Buffer, blockSize uint32) (err error) {
+	data, err := pd.readOperationData(iop, readBuf)
+	if err != nil {
+		return err
+	}
+
+	iopReader := io.Reader(bytes.NewReader(data))
+	switch iop.GetType() {
+	case InstallOperation_REPLACE_XZ:
+		iopReader, err = xz.NewReader(iopReader, 0)
+		if err != nil {
+			return fmt.Errorf("Failed to decode XZ stream: %v", err)
+		}
+	case InstallOperation_REPLACE_BZ:
+		iopReader = bzip2.NewReader(iopReader)
+	case InstallOperation_REPLACE:
+		// nothing to do
+	}
+
+	return writeExtents(output, iopReader, iop.GetDstExtents(), blockSize)
+}
+
+func performSourceCopyOperation(sourceImage io.ReaderAt, output io.WriterAt, iop *InstallOperation, blockSize uint32) error {
+	if sourceImage == nil {
+		return fmt.Errorf("SOURCE_COPY operation requires --source-dir")
+	}
+	srcBytes, err := readSourceExtents(sourceImage, iop, blockSize)
+	if err != nil {
+		return err
+	}
+	return writeExtents(output, bytes.NewReader(srcBytes), iop.GetDstExtents(), blockSize)
+}
+
+func (pd *payloadDumper) performSourceBsdiffOperation(sourceImage io.ReaderAt, output io.WriterAt, iop *InstallOperation, readBuf *bytes.Buffer, blockSize uint32) error {
+	if sourceImage == nil {
+		return fmt.Errorf("%v operation requires --source-dir", iop.GetType())
+	}
+	srcBytes, err := readSourceExtents(sourceImage, iop, blockSize)
+	if err != nil {
+		return err
+	}
+	patch, err := pd.readOperationData(iop, readBuf)
+	if err != nil {
+		return err
+	}
+	if iop.GetType() == InstallOperation_BROTLI_BSDIFF {
+		decoded, err := ioutil.ReadAll(brotli.NewReader(bytes.NewReader(patch)))
+		if err != nil {
+			return fmt.Errorf("Failed to decode brotli bsdiff patch: %v", err)
+		}
+		patch = decoded
+	}
+	dstBytes, err := bspatch.Bytes(srcBytes, patch)
+	if err != nil {
+		return fmt.Errorf("Failed to apply bsdiff patch: %v", err)
+	}
+	return writeExtents(output, bytes.NewReader(dstBytes), iop.GetDstExtents(), blockSize)
+}
+
+func (pd *payloadDumper) performPuffdiffOperation(sourceImage io.ReaderAt, output io.WriterAt, iop *InstallOperation, readBuf *bytes.Buffer, blockSize uint32) error {
+	if sourceImage == nil {
+		return fmt.Errorf("PUFFDIFF operation requires --source-dir")
+	}
+	srcBytes, err := readSourceExtents(sourceImage, iop, blockSize)
+	if err != nil {
+		return err
+	}
+	patch, err := pd.readOperationData(iop, readBuf)
+	if err != nil {
+		return err
+	}
+	dstBytes, err := applyPuffpatch(srcBytes, patch)
+	if err != nil {
+		return fmt.Errorf("Failed to apply puffin patch: %v", err)
+	}
+	return writeExtents(output, bytes.NewReader(dstBytes), iop.GetDstExtents(), blockSize)
+}
@@ -1,21 +1,17 @@
 package main
 
 import (
-	"bufio"
 	"bytes"
-	"compress/bzip2"
-	"crypto/sha256"
 	"encoding/binary"
-	"encoding/hex"
 	"errors"
 	"flag"
 	"fmt"
 	"github.com/golang/protobuf/proto"
-	"github.com/xi2/xz"
-	"hash"
 	"io"
 	"log"
 	"os"
+	"runtime"
+	"sync"
 )
 
 const (
@@ -39,33 +35,77 @@ func (header *payloadHeader) String() string {
 }
 
 type payloadDumper struct {
-	payloadFile       *os.File
+	src               io.ReaderAt
+	srcSize           int64
 	outputDir         string
 	version           uint64
 	archiveManifest   *DeltaArchiveManifest
 	metaDataSignature *Signatures
 	dataOffset        int64
+	// Concurrency is the number of partitions dumped in parallel. Defaults to
+	// runtime.NumCPU() if left at zero.
+	Concurrency int
+	// Reporter receives progress events; defaults to a quiet no-op reporter.
+	Reporter Reporter
+	// Partitions, if non-empty, restricts dumping to these partition names.
+	Partitions []string
+	// Exclude removes these partition names from the dump, applied after Partitions.
+	Exclude []string
+	// Resume skips partitions whose output already matches the expected hash,
+	// and replays only the unwritten tail of a partially-written partition.
+	Resume bool
+	// Force overwrites existing output files unconditionally.
+	Force bool
+	// SourceDir holds previous-partition images for delta payloads. When
+	// set, SOURCE_COPY/SOURCE_BSDIFF/BROTLI_BSDIFF/PUFFDIFF operations read
+	// their source bytes from <SourceDir>/<partition>.img.
+	SourceDir string
+	// Verify, if set, hashes each partition after writing it and compares
+	// against PartitionUpdate.NewPartitionInfo.Hash. Callers should also call
+	// VerifyPayload before dumping to check the metadata and payload signatures.
+	Verify bool
+
+	verifyMu sync.Mutex
+	// VerifyResults accumulates one entry per partition once dumping
+	// finishes, populated only when Verify is set.
+	VerifyResults []VerifyResult
+
+	// metadataSize is the byte length of the header fields plus manifest,
+	// i.e. everything preceding the metadata signature blob, which is what
+	// the metadata signature is computed over.
+	metadataSize int64
 }
 
-func NewPayloadDumper(fileName string) (pd *payloadDumper, err error) {
+// partitionRequest is a unit of work handed to a dump worker.
+type partitionRequest struct {
+	partition *PartitionUpdate
+	targetDir string
+}
+
+// NewPayloadDumper opens a payload for dumping. location may be a local
+// payload.bin, a local OTA.zip, or an http(s) URL to either; http(s) sources
+// and zip entries are read on demand via byte ranges rather than downloaded
+// or decompressed up front.
+func NewPayloadDumper(location string) (pd *payloadDumper, err error) {
 	pd = &payloadDumper{}
-	if pd.payloadFile, err = os.Open(fileName); err != nil {
+	if pd.src, pd.srcSize, err = openSource(location); err != nil {
 		return
 	}
+	cursor := &readAtCursor{r: pd.src}
 	header := payloadHeader{}
 
-	if err = binary.Read(pd.payloadFile, binary.BigEndian, &header.magic); err != nil {
+	if err = binary.Read(cursor, binary.BigEndian, &header.magic); err != nil {
 		return
 	}
 	if PAYLOAD_MAGIC != string(header.magic[:]) {
 		err = ERR_INVALID_FORMAT_BAD_MAGIC
 		return
 	}
-	if err = binary.Read(pd.payloadFile, binary.BigEndian, &header.fileFormatVersion); err != nil {
+	if err = binary.Read(cursor, binary.BigEndian, &header.fileFormatVersion); err != nil {
 		err = fmt.Errorf("Error reading payload, failed to read version: %v", err)
 		return
 	}
-	if err = binary.Read(pd.payloadFile, binary.BigEndian, &header.manifestSize); err != nil {
+	if err = binary.Read(cursor, binary.BigEndian, &header.manifestSize); err != nil {
 		err = fmt.Errorf("Error reading payload, failed to read manifest size: %v", err)
 		return
 	}
@@ -76,17 +116,17 @@ func NewPayloadDumper(fileName string) (pd *payloadDumper, err error) {
 	}
 
 	if header.fileFormatVersion >= 2 {
-		if err = binary.Read(pd.payloadFile, binary.BigEndian, &header.metaDataSignatureSize); err != nil {
+		if err = binary.Read(cursor, binary.BigEndian, &header.metaDataSignatureSize); err != nil {
 			err = fmt.Errorf("Error reading payload, failed to read manifest data signature size: %v", err)
 			return
 		}
 	}
 
-	//log.Printf("Opening payload file %s, header info %s", fileName, header.String())
+	//log.Printf("Opening payload %s, header info %s", location, header.String())
 
 	// decode the DeltaArchiveManifest
 	buf := make([]byte, header.manifestSize)
-	if err = binary.Read(pd.payloadFile, binary.BigEndian, &buf); err != nil {
+	if err = binary.Read(cursor, binary.BigEndian, &buf); err != nil {
 		err = fmt.Errorf("Error reading payload, failed to read manifest: %v", err)
 		return
 	}
@@ -98,10 +138,15 @@ func NewPayloadDumper(fileName string) (pd *payloadDumper, err error) {
 	}
 
 	//log.Printf("Read archive manifest: %s", pd.archiveManifest.String())
+
+	// the metadata signature covers everything read so far (header fields
+	// plus manifest), but not the signature bytes themselves
+	pd.metadataSize = cursor.pos
+
 	if header.metaDataSignatureSize > 0 {
 		// decode the Signatures
 		buf = make([]byte, header.metaDataSignatureSize)
-		if err = binary.Read(pd.payloadFile, binary.BigEndian, &buf); err != nil {
+		if err = binary.Read(cursor, binary.BigEndian, &buf); err != nil {
 			err = fmt.Errorf("Error reading payload, failed to read metadata signature: %v", err)
 			return
 		}
@@ -113,149 +158,225 @@ func NewPayloadDumper(fileName string) (pd *payloadDumper, err error) {
 		}
 	}
 
-	// TODO, sanity check signatures before returning
-
 	// everything else done on the return
 	pd.version = header.fileFormatVersion
 
 	// theoretically the immediate next should be data
-	pd.dataOffset, err = pd.payloadFile.Seek(0, os.SEEK_CUR)
-	if err != nil {
-		err = fmt.Errorf("Error reading payload, failed to record offset of data start: %v", err)
-		return
-	}
+	pd.dataOffset = cursor.pos
 
 	return
 }
 
-func (pd *payloadDumper) performInstallOperation(output io.Writer, iop *InstallOperation, readBuf *bytes.Buffer) (err error) {
-	readStart := int64(iop.GetDataOffset())
-	readSize := int64(iop.GetDataLength())
-	//log.Printf("Performing install operation: %v, data start %d, read offset %d, read start: %d, read size %d", iop.GetType(), pd.dataOffset, readStart, int64(readStart) + pd.dataOffset, readSize)
-	// reset buf
-	readBuf.Reset()
-	// seek to start
-	_, err = pd.payloadFile.Seek(pd.dataOffset+readStart, 0)
+// readAtCursor adapts an io.ReaderAt into a sequential io.Reader, used only
+// to parse the fixed-layout header and manifest at the front of the payload.
+type readAtCursor struct {
+	r   io.ReaderAt
+	pos int64
+}
+
+func (c *readAtCursor) Read(p []byte) (n int, err error) {
+	n, err = c.r.ReadAt(p, c.pos)
+	c.pos += int64(n)
+	return
+}
+
+// partitionDstBytes returns the total number of decompressed bytes a
+// partition's operations will produce, used to size progress totals.
+func partitionDstBytes(pu *PartitionUpdate, blockSize uint32) int64 {
+	var total int64
+	for _, iop := range pu.GetOperations() {
+		for _, e := range iop.GetDstExtents() {
+			total += int64(e.GetNumBlocks()) * int64(blockSize)
+		}
+	}
+	return total
+}
+
+func (pd *payloadDumper) dumpPartition(pu *PartitionUpdate, targetDir string, readBuf *bytes.Buffer) (err error) {
+	outputFileName := targetDir + string(os.PathSeparator) + pu.GetPartitionName() + ".img"
+	blockSize := pd.archiveManifest.GetBlockSize()
+	expectedSize := int64(pu.GetNewPartitionInfo().GetSize())
+
+	state, err := planResume(pu, outputFileName, pd.Force, pd.Resume)
 	if err != nil {
-		err = fmt.Errorf("Failed to seek to install operation start: %v", err)
 		return
 	}
+	if state.complete {
+		log.Printf("Partition '%s' already complete, skipping (--resume)", pu.GetPartitionName())
+		total := partitionDstBytes(pu, blockSize)
+		pd.Reporter.PartitionStarted(pu.GetPartitionName(), total)
+		pd.Reporter.PartitionProgress(pu.GetPartitionName(), total)
+		if pd.Verify {
+			// planResume already confirmed this file's hash matches
+			pd.recordVerifyResult(VerifyResult{Partition: pu.GetPartitionName(), DataHashOK: true})
+		}
+		return nil
+	}
 
-	// if there's a data hash, setup to hash data on read
-	var srcDataReader io.Reader
-	var hasher hash.Hash
-	if iop.GetDataSha256Hash() != nil && len(iop.GetDataSha256Hash()) > 0 {
-		hasher = sha256.New()
-		srcDataReader = io.TeeReader(pd.payloadFile, hasher)
+	var outputFile *os.File
+	if state.resumeOps > 0 {
+		log.Printf("Resuming partition '%s' from operation %d in file %s", pu.GetPartitionName(), state.resumeOps, outputFileName)
+		outputFile, err = os.OpenFile(outputFileName, os.O_RDWR, 0644)
 	} else {
-		srcDataReader = io.Reader(pd.payloadFile)
+		log.Printf("Dumping partition '%s' to file %s", pu.GetPartitionName(), outputFileName)
+		outputFile, err = os.Create(outputFileName)
 	}
-
-	// read the expected data
-	bytesRead, err := io.CopyN(readBuf, srcDataReader, readSize)
 	if err != nil {
-		err = fmt.Errorf("Failed to read install operation: %v", err)
+		err = fmt.Errorf("Failed to open output file %s: %v", outputFileName, err)
 		return
 	}
-	if bytesRead != readSize {
-		err = fmt.Errorf("Read %d bytes, expecting %d", bytesRead, readSize)
+	defer outputFile.Close()
+	// operations write their destination extents directly via WriteAt, so the
+	// file must already be the right size before any delta op can land past
+	// the current end of file.
+	if err = outputFile.Truncate(expectedSize); err != nil {
+		err = fmt.Errorf("Failed to size output file %s: %v", outputFileName, err)
 		return
 	}
 
-	// if there was a data hash, validate 
-	if hasher != nil {
-		dataSum := hasher.Sum(nil)
-		if bytes.Compare(dataSum, iop.GetDataSha256Hash()) != 0 {
-			err = fmt.Errorf("SHA256 failed for operation, expected %s, calculated %s", hex.EncodeToString(iop.GetDataSha256Hash()), hex.EncodeToString(dataSum))
+	var sourceImage io.ReaderAt
+	if pd.SourceDir != "" {
+		sourceFileName := pd.SourceDir + string(os.PathSeparator) + pu.GetPartitionName() + ".img"
+		sourceFile, openErr := os.Open(sourceFileName)
+		if openErr != nil {
+			err = fmt.Errorf("Failed to open source partition image %s: %v", sourceFileName, openErr)
 			return
 		}
+		defer sourceFile.Close()
+		sourceImage = sourceFile
 	}
 
-	iopReader := io.Reader(bytes.NewReader(readBuf.Bytes()))
-	switch iop.GetType() {
-	case InstallOperation_REPLACE_XZ:
-		iopReader, err = xz.NewReader(iopReader, 0)
+	markerPath := progressMarkerPath(outputFileName)
+	ops := pu.GetOperations()
+	total := partitionDstBytes(pu, blockSize)
+	pd.Reporter.PartitionStarted(pu.GetPartitionName(), total)
+	written := operationsDstBytesUpTo(ops, state.resumeOps, blockSize)
+	pd.Reporter.PartitionProgress(pu.GetPartitionName(), written)
+	opsDone := state.resumeOps
+	for i, iop := range ops {
+		if i < state.resumeOps {
+			// already applied and recorded in the marker by a prior run
+			continue
+		}
+
+		err = pd.performInstallOperation(sourceImage, outputFile, iop, readBuf, blockSize)
 		if err != nil {
-			err = fmt.Errorf("Failed to decode XZ stream: %v", err)
+			err = fmt.Errorf("Failed to dump partition '%s': %v", pu.GetPartitionName(), err)
 			return
 		}
-	case InstallOperation_REPLACE_BZ:
-		iopReader = bzip2.NewReader(iopReader)
-	case InstallOperation_REPLACE:
-		// nothing to do
-	default:
-		err = fmt.Errorf("Unimplemented install operation type: %v", iop.GetType())
-		return
+		opsDone++
+		written += operationDstBytes(iop, blockSize)
+		if markerErr := writeProgressMarker(markerPath, opsDone); markerErr != nil {
+			err = fmt.Errorf("Failed to update progress marker for partition '%s': %v", pu.GetPartitionName(), markerErr)
+			return
+		}
+		pd.Reporter.PartitionProgress(pu.GetPartitionName(), written)
 	}
 
-	if iopReader != nil {
-		_, err = io.Copy(output, iopReader)
-		if err != nil {
-			err = fmt.Errorf("Error copying install operation to output file: %v", err)
+	if pd.Verify {
+		if hashErr := pd.verifyPartitionHash(pu, outputFileName); hashErr != nil {
+			err = fmt.Errorf("Partition '%s' failed verification: %v", pu.GetPartitionName(), hashErr)
 			return
 		}
-		//log.Printf("%d bytes copied to output file", bytesCopied)
+	}
+
+	if removeErr := os.Remove(markerPath); removeErr != nil && !os.IsNotExist(removeErr) {
+		log.Printf("Warning: failed to remove progress marker %s: %v", markerPath, removeErr)
 	}
 
 	return
 }
 
-func (pd *payloadDumper) dumpPartition(pu *PartitionUpdate, readBuf *bytes.Buffer) (err error) {
-	outputFileName := pd.outputDir + string(os.PathSeparator) + pu.GetPartitionName() + ".img"
-	log.Printf("Dumping partition '%s' to file %s", pu.GetPartitionName(), outputFileName)
-	// TODO, check for file and don't overwrite unless specified
-	outputFile, err := os.Create(outputFileName)
-	if err != nil {
-		err = fmt.Errorf("Failed to create output file %s: %v", outputFileName, err)
-		return
-	}
-	defer outputFile.Close()
-	output := bufio.NewWriter(outputFile)
-	defer output.Flush()
-	for _, io := range pu.GetOperations() {
-		// TODO, convert this to a goroutine?  Will need to sync around the file read/writes, but the decompression seems to be single threaded
-		// right now, so might gain a little benefit.. if nothing else, interesting exercise..
-		err = pd.performInstallOperation(output, io, readBuf)
+// dumpWorker pulls partition requests off reqs until it's closed, or stops
+// after the first partition that fails, sending that error on errs. Workers
+// share pd.src directly: reads are done via io.NewSectionReader against an
+// io.ReaderAt, which is safe for concurrent use without per-worker handles.
+func (pd *payloadDumper) dumpWorker(reqs <-chan partitionRequest, readBuf *bytes.Buffer, errs chan<- error) {
+	for req := range reqs {
+		err := pd.dumpPartition(req.partition, req.targetDir, readBuf)
+		pd.Reporter.PartitionDone(req.partition.GetPartitionName(), err)
 		if err != nil {
-			err = fmt.Errorf("Failed to dump partition '%s': %v", pu.GetPartitionName(), err)
+			errs <- err
 			return
 		}
-		fmt.Print(".")
 	}
-	fmt.Print("\n")
-
-	return
 }
 
 func (pd *payloadDumper) dumpV2() (err error) {
-	log.Printf("Payload contains %d partitions", len(pd.archiveManifest.Partitions))
-	// figure out the largest # of blocks we're going to be dumping.. we'll create one buffer and reuse
+	partitions := filterPartitions(pd.archiveManifest.Partitions, pd.Partitions, pd.Exclude)
+	log.Printf("Payload contains %d partitions, %d selected", len(pd.archiveManifest.Partitions), len(partitions))
+
+	if pd.Reporter == nil {
+		pd.Reporter = NewQuietReporter()
+	}
+	concurrency := pd.Concurrency
+	if concurrency <= 0 {
+		concurrency = runtime.NumCPU()
+	}
+	if concurrency > len(partitions) {
+		concurrency = len(partitions)
+	}
+	if concurrency < 1 {
+		concurrency = 1
+	}
+
+	// figure out the largest # of blocks we're going to be dumping.. each worker
+	// gets its own buffer sized to this, so they never trample each other
 	var largestBlockCount uint64
-	for _, pu := range pd.archiveManifest.Partitions {
-		for _, io := range pu.GetOperations() {
-			for _, e := range io.GetDstExtents() {
+	for _, pu := range partitions {
+		for _, iop := range pu.GetOperations() {
+			for _, e := range iop.GetDstExtents() {
 				if e.GetNumBlocks() > largestBlockCount {
 					largestBlockCount = e.GetNumBlocks()
 				}
 			}
 		}
 	}
-	readBuf := bytes.NewBuffer(make([]byte, largestBlockCount*uint64(pd.archiveManifest.GetBlockSize())))
-	//log.Printf("Created buffer of size %d to read largest extent block count of %d", readBuf.Cap(), largestBlockCount)
-	for _, pu := range pd.archiveManifest.Partitions {
-		err = pd.dumpPartition(pu, readBuf)
-		if err != nil {
-			return
+	bufSize := largestBlockCount * uint64(pd.archiveManifest.GetBlockSize())
+
+	reqs := make(chan partitionRequest, len(partitions))
+	errs := make(chan error, concurrency)
+	var wg sync.WaitGroup
+	for i := 0; i < concurrency; i++ {
+		readBuf := bytes.NewBuffer(make([]byte, bufSize))
+		wg.Add(1)
+		go func(readBuf *bytes.Buffer) {
+			defer wg.Done()
+			pd.dumpWorker(reqs, readBuf, errs)
+		}(readBuf)
+	}
+
+	for _, pu := range partitions {
+		reqs <- partitionRequest{partition: pu, targetDir: pd.outputDir}
+	}
+	close(reqs)
+	wg.Wait()
+	close(errs)
+
+	for e := range errs {
+		if err == nil {
+			err = e
 		}
 	}
 	return
 }
 
 func main() {
-	var payloadFile, outputDir string
+	var payloadFile, outputDir, progress, partitionsFlag, excludeFlag, sourceDir, pubkeyFlag string
+	var concurrency int
+	var resume, force, verify bool
 
-	flag.StringVar(&payloadFile, "file", "", "payload filename")
+	flag.StringVar(&payloadFile, "file", "", "payload.bin path, OTA.zip path, or http(s) URL to either")
 	flag.StringVar(&outputDir, "outdir", ".", "output directory")
+	flag.IntVar(&concurrency, "concurrency", runtime.NumCPU(), "number of partitions to dump in parallel")
+	flag.StringVar(&progress, "progress", "bar", "progress reporter: bar, quiet, or json")
+	flag.StringVar(&partitionsFlag, "partitions", "", "comma-separated list of partition names to dump (default all)")
+	flag.StringVar(&excludeFlag, "exclude", "", "comma-separated list of partition names to skip")
+	flag.BoolVar(&resume, "resume", false, "skip partitions already fully dumped and resume partial ones")
+	flag.BoolVar(&force, "force", false, "overwrite existing output files")
+	flag.StringVar(&sourceDir, "source-dir", "", "directory of previous partition images, for delta payloads")
+	flag.BoolVar(&verify, "verify", false, "verify the metadata/payload signatures and each partition's hash after dumping")
+	flag.StringVar(&pubkeyFlag, "pubkey", "", "comma-separated paths to trusted public key PEM files, required with --verify")
 	flag.Parse()
 
 	if payloadFile == "" {
@@ -263,14 +384,41 @@ func main() {
 		log.Fatal("Payload file not specified")
 	}
 
+	reporter, err := reporterByName(progress)
+	if err != nil {
+		log.Fatal(err)
+	}
+
 	dumper, err := NewPayloadDumper(payloadFile)
-	if dumper.payloadFile != nil {
-		defer dumper.payloadFile.Close()
+	if dumper != nil {
+		if closer, ok := dumper.src.(io.Closer); ok {
+			defer closer.Close()
+		}
 	}
 	if err != nil {
-		log.Fatalf("Failed to open payload file %s: %v", payloadFile, err)
+		log.Fatalf("Failed to open payload %s: %v", payloadFile, err)
 	}
 	dumper.outputDir = outputDir
+	dumper.Concurrency = concurrency
+	dumper.Reporter = reporter
+	dumper.Partitions = splitCSV(partitionsFlag)
+	dumper.Exclude = splitCSV(excludeFlag)
+	dumper.Resume = resume
+	dumper.Force = force
+	dumper.SourceDir = sourceDir
+	dumper.Verify = verify
+
+	if verify {
+		pubKeys, pubkeyErr := loadPublicKeys(splitCSV(pubkeyFlag))
+		if pubkeyErr != nil {
+			log.Fatal(pubkeyErr)
+		}
+		if verifyErr := dumper.VerifyPayload(pubKeys); verifyErr != nil {
+			log.Fatalf("Payload verification failed: %v", verifyErr)
+		}
+		log.Printf("Payload metadata/signature verification passed")
+	}
+
 	log.Printf("Detected payload version %d", dumper.version)
 	switch dumper.version {
 	case 2:
@@ -281,4 +429,18 @@ func main() {
 	if err != nil {
 		log.Fatalf("Failed to dump payload: %v", err)
 	}
+
+	if verify {
+		failed := 0
+		for _, vr := range dumper.VerifyResults {
+			if vr.Err != nil {
+				failed++
+				log.Printf("Partition '%s' FAILED hash verification: %v", vr.Partition, vr.Err)
+			}
+		}
+		if failed > 0 {
+			log.Fatalf("%d partition(s) failed hash verification", failed)
+		}
+		log.Printf("All %d verified partitions passed", len(dumper.VerifyResults))
+	}
 }
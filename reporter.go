@@ -0,0 +1,176 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+)
+
+// Reporter receives progress events as partitions are dumped. Implementations
+// must be safe for concurrent use since multiple workers report in parallel.
+type Reporter interface {
+	// PartitionStarted is called once a partition's total decompressed size is known.
+	PartitionStarted(name string, total int64)
+	// PartitionProgress is called as bytes are written for a partition; written is
+	// cumulative, not a delta.
+	PartitionProgress(name string, written int64)
+	// PartitionDone is called when a partition finishes, successfully or not.
+	PartitionDone(name string, err error)
+}
+
+// barReporter prints one progress bar per partition, in the order partitions
+// started, plus a trailing overall line (percentage and partitions done),
+// redrawing the whole block in place on every update.
+type barReporter struct {
+	mu      sync.Mutex
+	order   []string
+	totals  map[string]int64
+	written map[string]int64
+	done    map[string]bool
+	// linesDrawn is the height of the block printed by the previous redraw,
+	// so the next redraw can move the cursor back up and overwrite it.
+	linesDrawn int
+}
+
+func NewBarReporter() Reporter {
+	return &barReporter{
+		totals:  make(map[string]int64),
+		written: make(map[string]int64),
+		done:    make(map[string]bool),
+	}
+}
+
+func (r *barReporter) PartitionStarted(name string, total int64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.totals[name]; !ok {
+		r.order = append(r.order, name)
+	}
+	r.totals[name] = total
+	r.written[name] = 0
+	r.redraw()
+}
+
+func (r *barReporter) PartitionProgress(name string, written int64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.written[name] = written
+	r.redraw()
+}
+
+func (r *barReporter) PartitionDone(name string, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.done[name] = true
+	if err != nil {
+		fmt.Printf("\n%s: failed: %v\n", name, err)
+		r.linesDrawn = 0
+	}
+	r.redraw()
+}
+
+// bar renders a simple "[###   ] NN%" progress bar of the given width.
+func bar(written, total int64, width int) string {
+	pct := 0
+	if total > 0 {
+		pct = int(written * 100 / total)
+	}
+	filled := pct * width / 100
+	return fmt.Sprintf("[%s%s] %3d%%", strings.Repeat("#", filled), strings.Repeat(" ", width-filled), pct)
+}
+
+// redraw must be called with r.mu held. It moves the cursor back to the top
+// of the block drawn by the previous call (if any), then reprints one line
+// per partition followed by the overall line.
+func (r *barReporter) redraw() {
+	if r.linesDrawn > 0 {
+		fmt.Printf("\x1b[%dA", r.linesDrawn)
+	}
+
+	var total, written int64
+	for _, name := range r.order {
+		t := r.totals[name]
+		w := r.written[name]
+		total += t
+		written += w
+		status := "running"
+		if r.done[name] {
+			status = "done"
+		}
+		fmt.Printf("\r\x1b[K%-20s %s %s\n", name, bar(w, t, 20), status)
+	}
+
+	pct := 0
+	if total > 0 {
+		pct = int(written * 100 / total)
+	}
+	fmt.Printf("\r\x1b[Koverall: %3d%% (%d/%d partitions done)\n", pct, len(r.done), len(r.totals))
+
+	r.linesDrawn = len(r.order) + 1
+}
+
+// quietReporter discards all progress events.
+type quietReporter struct{}
+
+func NewQuietReporter() Reporter { return quietReporter{} }
+
+func (quietReporter) PartitionStarted(name string, total int64)    {}
+func (quietReporter) PartitionProgress(name string, written int64) {}
+func (quietReporter) PartitionDone(name string, err error)         {}
+
+// jsonReporter emits one JSON object per line to stdout for each event, for
+// callers that want to consume progress programmatically.
+type jsonReporter struct {
+	mu  sync.Mutex
+	enc *json.Encoder
+}
+
+func NewJSONReporter() Reporter {
+	return &jsonReporter{enc: json.NewEncoder(os.Stdout)}
+}
+
+type jsonReportEvent struct {
+	Partition string `json:"partition"`
+	Event     string `json:"event"`
+	Bytes     int64  `json:"bytes,omitempty"`
+	Total     int64  `json:"total,omitempty"`
+	Error     string `json:"error,omitempty"`
+}
+
+func (r *jsonReporter) PartitionStarted(name string, total int64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.enc.Encode(jsonReportEvent{Partition: name, Event: "started", Total: total})
+}
+
+func (r *jsonReporter) PartitionProgress(name string, written int64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.enc.Encode(jsonReportEvent{Partition: name, Event: "progress", Bytes: written})
+}
+
+func (r *jsonReporter) PartitionDone(name string, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	ev := jsonReportEvent{Partition: name, Event: "done"}
+	if err != nil {
+		ev.Error = err.Error()
+	}
+	r.enc.Encode(ev)
+}
+
+// reporterByName resolves the --progress flag value to a Reporter.
+func reporterByName(name string) (Reporter, error) {
+	switch name {
+	case "", "bar":
+		return NewBarReporter(), nil
+	case "quiet":
+		return NewQuietReporter(), nil
+	case "json":
+		return NewJSONReporter(), nil
+	default:
+		return nil, fmt.Errorf("unknown progress reporter %q, expected bar, quiet, or json", name)
+	}
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// splitCSV splits a comma-separated flag value into its trimmed parts,
+// returning nil for an empty input.
+func splitCSV(s string) []string {
+	if s == "" {
+		return nil
+	}
+	parts := strings.Split(s, ",")
+	out := make([]string, 0, len(parts))
+	for _, p := range parts {
+		if p = strings.TrimSpace(p); p != "" {
+			out = append(out, p)
+		}
+	}
+	return out
+}
+
+// filterPartitions narrows partitions down to the --partitions allow-list (if
+// any) minus the --exclude deny-list. Empty include means "all partitions".
+func filterPartitions(partitions []*PartitionUpdate, include, exclude []string) []*PartitionUpdate {
+	if len(include) == 0 && len(exclude) == 0 {
+		return partitions
+	}
+	includeSet := toNameSet(include)
+	excludeSet := toNameSet(exclude)
+
+	var out []*PartitionUpdate
+	for _, pu := range partitions {
+		name := pu.GetPartitionName()
+		if len(includeSet) > 0 {
+			if _, ok := includeSet[name]; !ok {
+				continue
+			}
+		}
+		if _, ok := excludeSet[name]; ok {
+			continue
+		}
+		out = append(out, pu)
+	}
+	return out
+}
+
+func toNameSet(names []string) map[string]bool {
+	set := make(map[string]bool, len(names))
+	for _, n := range names {
+		if n != "" {
+			set[n] = true
+		}
+	}
+	return set
+}
+
+// sha256File hashes the entire contents of the file at path.
+func sha256File(path string) ([]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	hasher := sha256.New()
+	if _, err := io.Copy(hasher, f); err != nil {
+		return nil, err
+	}
+	return hasher.Sum(nil), nil
+}
+
+// operationDstBytes returns the number of decompressed bytes a single
+// install operation writes to the output partition image.
+func operationDstBytes(iop *InstallOperation, blockSize uint32) int64 {
+	var total int64
+	for _, e := range iop.GetDstExtents() {
+		total += int64(e.GetNumBlocks()) * int64(blockSize)
+	}
+	return total
+}
+
+// operationsDstBytesUpTo sums operationDstBytes over the first n operations,
+// used only to report a byte count for progress display; resume itself
+// trusts n operations, not a byte offset.
+func operationsDstBytesUpTo(ops []*InstallOperation, n int, blockSize uint32) int64 {
+	var total int64
+	for _, iop := range ops[:n] {
+		total += operationDstBytes(iop, blockSize)
+	}
+	return total
+}
+
+// progressMarkerPath returns the sidecar file dumpPartition uses to record
+// how far a partial dump of outputFileName has gotten. The output file
+// itself is pre-sized to its expected length before any bytes are written
+// (operations land via WriteAt, in whatever order the payload lists them),
+// so an interrupted run leaves a full-size file with unwritten holes; the
+// marker, not the file's size or hash, is what makes that state recognizable
+// on the next --resume.
+func progressMarkerPath(outputFileName string) string {
+	return outputFileName + ".progress"
+}
+
+// writeProgressMarker records opsDone (the number of leading operations, in
+// manifest order, that have been fully applied) to path, overwriting any
+// previous value.
+func writeProgressMarker(path string, opsDone int) error {
+	return ioutil.WriteFile(path, []byte(strconv.Itoa(opsDone)), 0644)
+}
+
+// readProgressMarker reads back a marker written by writeProgressMarker. ok
+// is false if no marker exists yet.
+func readProgressMarker(path string) (opsDone int, ok bool, err error) {
+	data, readErr := ioutil.ReadFile(path)
+	if os.IsNotExist(readErr) {
+		return 0, false, nil
+	}
+	if readErr != nil {
+		return 0, false, readErr
+	}
+	opsDone, err = strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil {
+		return 0, false, fmt.Errorf("malformed progress marker %s: %v", path, err)
+	}
+	return opsDone, true, nil
+}
+
+// existingOutputState describes what dumpPartition should do about an
+// already-present output file.
+type existingOutputState struct {
+	// complete is true if the existing file already matches the expected
+	// size and hash, and dumping can be skipped entirely.
+	complete bool
+	// resumeOps is the number of leading operations, in manifest order,
+	// that a prior run already applied and recorded in the progress marker.
+	// Operations are skipped by count, not by destination byte offset:
+	// delta payloads (SOURCE_COPY/BSDIFF/PUFFDIFF) scatter their dst extents
+	// in whatever order the manifest lists them, so "cumulative bytes
+	// written so far" doesn't correspond to "which operations are done".
+	resumeOps int
+}
+
+// planResume inspects an existing output file and decides whether the
+// partition is already complete, can be resumed from partway through, or is
+// an error condition the caller should surface to the user.
+func planResume(pu *PartitionUpdate, outputFileName string, force, resume bool) (state existingOutputState, err error) {
+	info, statErr := os.Stat(outputFileName)
+	if os.IsNotExist(statErr) {
+		return existingOutputState{}, nil
+	}
+	if statErr != nil {
+		return existingOutputState{}, statErr
+	}
+
+	markerPath := progressMarkerPath(outputFileName)
+	if force {
+		_ = os.Remove(markerPath)
+		return existingOutputState{}, nil
+	}
+	if !resume {
+		err = fmt.Errorf("output file %s already exists; rerun with --force or --resume", outputFileName)
+		return
+	}
+
+	expectedSize := int64(pu.GetNewPartitionInfo().GetSize())
+	expectedHash := pu.GetNewPartitionInfo().GetHash()
+
+	if opsDone, ok, markerErr := readProgressMarker(markerPath); markerErr != nil {
+		err = fmt.Errorf("failed to read progress marker for %s: %v", outputFileName, markerErr)
+		return
+	} else if ok {
+		// a prior run was interrupted partway through; trust exactly what it
+		// recorded rather than inspecting the (pre-sized, possibly sparse)
+		// file itself.
+		if opsDone > len(pu.GetOperations()) {
+			opsDone = len(pu.GetOperations())
+		}
+		return existingOutputState{resumeOps: opsDone}, nil
+	}
+
+	if info.Size() != expectedSize {
+		err = fmt.Errorf("existing file %s (%d bytes) doesn't match expected size (%d) and has no progress marker; rerun with --force to overwrite", outputFileName, info.Size(), expectedSize)
+		return
+	}
+
+	sum, hashErr := sha256File(outputFileName)
+	if hashErr != nil {
+		err = fmt.Errorf("failed to hash existing file %s: %v", outputFileName, hashErr)
+		return
+	}
+	if bytes.Equal(sum, expectedHash) {
+		return existingOutputState{complete: true}, nil
+	}
+	err = fmt.Errorf("existing file %s matches expected size but not hash; rerun with --force to overwrite", outputFileName)
+	return
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"io/ioutil"
+
+	"github.com/golang/protobuf/proto"
+)
+
+// VerifyResult reports the outcome of verifying a single partition's
+// assembled image hash after dumping, distinct from payload/metadata
+// signature failures which VerifyPayload returns directly.
+type VerifyResult struct {
+	Partition  string
+	DataHashOK bool
+	Err        error
+}
+
+func (pd *payloadDumper) recordVerifyResult(vr VerifyResult) {
+	pd.verifyMu.Lock()
+	defer pd.verifyMu.Unlock()
+	pd.VerifyResults = append(pd.VerifyResults, vr)
+}
+
+// loadPublicKeys parses the given PEM files into trusted RSA public keys,
+// accepting both PKIX ("BEGIN PUBLIC KEY") and raw PKCS1 ("BEGIN RSA PUBLIC
+// KEY") encodings, since both show up among the Android OTA signing keys in
+// circulation (e.g. update-payload-key.pub.pem).
+func loadPublicKeys(pemPaths []string) ([]*rsa.PublicKey, error) {
+	if len(pemPaths) == 0 {
+		return nil, fmt.Errorf("--verify requires at least one --pubkey PEM file (e.g. update-payload-key.pub.pem)")
+	}
+	keys := make([]*rsa.PublicKey, 0, len(pemPaths))
+	for _, path := range pemPaths {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to read public key %s: %v", path, err)
+		}
+		block, _ := pem.Decode(data)
+		if block == nil {
+			return nil, fmt.Errorf("No PEM block found in %s", path)
+		}
+		if pub, err := x509.ParsePKIXPublicKey(block.Bytes); err == nil {
+			rsaPub, ok := pub.(*rsa.PublicKey)
+			if !ok {
+				return nil, fmt.Errorf("Public key %s is not an RSA key", path)
+			}
+			keys = append(keys, rsaPub)
+			continue
+		}
+		rsaPub, err := x509.ParsePKCS1PublicKey(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to parse public key %s: %v", path, err)
+		}
+		keys = append(keys, rsaPub)
+	}
+	return keys, nil
+}
+
+// hashRange streams length bytes of src starting at offset through SHA-256
+// without buffering them, since the range being signed can span the entire
+// (potentially multi-gigabyte, possibly remote) payload.
+func hashRange(src io.ReaderAt, offset, length int64) ([]byte, error) {
+	hasher := sha256.New()
+	if _, err := io.Copy(hasher, io.NewSectionReader(src, offset, length)); err != nil {
+		return nil, err
+	}
+	return hasher.Sum(nil), nil
+}
+
+// verifySignatures checks that at least one of sigs.GetSignatures() is a
+// valid PKCS1v15/SHA256 signature over sum, by one of the trusted keys.
+func verifySignatures(sum []byte, sigs *Signatures, pubKeys []*rsa.PublicKey) error {
+	for _, sig := range sigs.GetSignatures() {
+		for _, pub := range pubKeys {
+			if rsa.VerifyPKCS1v15(pub, crypto.SHA256, sum, sig.GetData()) == nil {
+				return nil
+			}
+		}
+	}
+	return fmt.Errorf("no signature matched any trusted public key")
+}
+
+// VerifyPayload validates the embedded metadata signature, and, if present,
+// the trailing whole-payload signature blob, against pubKeys.
+func (pd *payloadDumper) VerifyPayload(pubKeys []*rsa.PublicKey) error {
+	if pd.metaDataSignature == nil {
+		return fmt.Errorf("payload has no metadata signature to verify")
+	}
+
+	metadataSum, err := hashRange(pd.src, 0, pd.metadataSize)
+	if err != nil {
+		return fmt.Errorf("Failed to read payload metadata: %v", err)
+	}
+	if err := verifySignatures(metadataSum, pd.metaDataSignature, pubKeys); err != nil {
+		return fmt.Errorf("metadata signature verification failed: %v", err)
+	}
+
+	sigSize := pd.archiveManifest.GetSignaturesSize()
+	if sigSize == 0 {
+		return nil
+	}
+	sigOffset := pd.archiveManifest.GetSignaturesOffset()
+
+	// the whole-payload signature covers everything from the start of the
+	// payload (header + manifest) through the data blob up to, but not
+	// including, the signature blob itself.
+	payloadSum, err := hashRange(pd.src, 0, pd.dataOffset+int64(sigOffset))
+	if err != nil {
+		return fmt.Errorf("Failed to read signed payload bytes: %v", err)
+	}
+
+	sigBytes := make([]byte, sigSize)
+	if _, err := pd.src.ReadAt(sigBytes, pd.dataOffset+int64(sigOffset)); err != nil {
+		return fmt.Errorf("Failed to read payload signature blob: %v", err)
+	}
+	payloadSignatures := &Signatures{}
+	if err := proto.Unmarshal(sigBytes, payloadSignatures); err != nil {
+		return fmt.Errorf("Failed to decode payload signature blob: %v", err)
+	}
+	if err := verifySignatures(payloadSum, payloadSignatures, pubKeys); err != nil {
+		return fmt.Errorf("payload signature verification failed: %v", err)
+	}
+	return nil
+}
+
+// verifyPartitionHash hashes the fully-written partition image at
+// outputFileName and compares it against the manifest's expected hash,
+// recording the outcome on pd.VerifyResults.
+func (pd *payloadDumper) verifyPartitionHash(pu *PartitionUpdate, outputFileName string) error {
+	vr := VerifyResult{Partition: pu.GetPartitionName()}
+	sum, err := sha256File(outputFileName)
+	if err != nil {
+		vr.Err = fmt.Errorf("failed to hash output: %v", err)
+	} else if expected := pu.GetNewPartitionInfo().GetHash(); !bytes.Equal(sum, expected) {
+		vr.Err = fmt.Errorf("hash mismatch: expected %x, got %x", expected, sum)
+	} else {
+		vr.DataHashOK = true
+	}
+	pd.recordVerifyResult(vr)
+	return vr.Err
+}